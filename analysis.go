@@ -0,0 +1,314 @@
+// Copyright 2013 Frederik Zipp.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"go/token"
+	"log"
+	"net/http"
+	"sort"
+
+	"code.google.com/p/go.tools/ssa"
+)
+
+// Span is a highlighted source range in the analysis overlay. It
+// carries enough information for the client to render a hover tooltip
+// and, for "callees" and "implements" spans, to link back to the
+// corresponding oracle query.
+type Span struct {
+	Start   int         `json:"start"`
+	End     int         `json:"end"`
+	Kind    string      `json:"kind"` // "type", "callees", "channel" or "implements"
+	Payload interface{} `json:"payload"`
+}
+
+// analysisIndex holds the analysis overlay spans for every source file
+// of the loaded program, computed once so that serveAnalysis can
+// answer requests without re-walking the SSA program each time.
+type analysisIndex struct {
+	spans map[string][]Span
+}
+
+// ForFile returns the overlay spans for the given file name, ordered
+// by Start.
+func (idx *analysisIndex) ForFile(file string) []Span {
+	return idx.spans[file]
+}
+
+// analysisIdx is the index built by buildAnalysisIndex once the
+// oracle's SSA program is available. It is nil, and /analysis serves
+// no spans, until that happens.
+var analysisIdx *analysisIndex
+
+// buildAnalysisIndex walks the package-level functions of prog once and
+// computes the same kinds of popups godoc's analysis package produces:
+// the static type of each value-producing instruction, the callee of
+// each statically dispatched call, the peers of each channel
+// send/receive, and the concrete types that satisfy an interface at
+// each interface conversion. Methods and anonymous functions are not
+// visited, so their bodies get no spans. It is meant to be called once,
+// right after the oracle and its SSA program have been built.
+func buildAnalysisIndex(prog *ssa.Program) *analysisIndex {
+	idx := &analysisIndex{spans: make(map[string][]Span)}
+	for _, pkg := range prog.AllPackages() {
+		for _, mem := range pkg.Members {
+			fn, ok := mem.(*ssa.Function)
+			if !ok {
+				continue
+			}
+			idx.indexFunction(prog.Fset, fn)
+		}
+	}
+	for file, spans := range idx.spans {
+		sort.Sort(byStart(spans))
+		idx.spans[file] = spans
+	}
+	return idx
+}
+
+// arrowLen is the byte length of the "<-" channel operator.
+const arrowLen = 2
+
+// indexFunction emits at most one span per instruction: "callees" for
+// a call with a static callee, "channel" for a channel send/receive,
+// "implements" for an interface conversion, and "type" for every other
+// value-producing instruction. Calls without a static callee get no
+// span, nor does an instruction whose identifier can't be located in
+// the source. It never falls through to a second, overlapping "type"
+// span for an instruction already handled above.
+//
+// None of Call.Pos() (the call's Lparen), Send/receive UnOp.Pos() (the
+// "<-" operator) is itself the identifier a hover should land on, so
+// each case below locates the actual operand identifier relative to
+// that operator position instead of treating the operator position as
+// an identifier.
+func (idx *analysisIndex) indexFunction(fset *token.FileSet, fn *ssa.Function) {
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			switch v := instr.(type) {
+			case *ssa.Call:
+				if callee := v.Call.StaticCallee(); callee != nil {
+					// v.Pos() is the call's Lparen; the callee
+					// identifier is whatever precedes it, e.g. "Foo"
+					// in "pkg.Foo(" or "foo(".
+					idx.addSpanBefore(fset, v.Pos(), "callees", callee.String())
+				}
+			case *ssa.Send:
+				// v.Pos() is the "<-" of "ch <- v"; the channel
+				// operand precedes it.
+				idx.addSpanBefore(fset, v.Pos(), "channel", nil)
+			case *ssa.UnOp:
+				if v.Op == token.ARROW {
+					// v.Pos() is the "<-" of "<-ch"; the channel
+					// operand follows it.
+					idx.addSpanAfter(fset, v.Pos(), arrowLen, "channel", nil)
+				} else {
+					idx.indexType(fset, v)
+				}
+			case *ssa.MakeInterface:
+				pos := v.Pos()
+				if !pos.IsValid() {
+					// Implicit conversions, e.g. passing a concrete
+					// value where an interface parameter is expected,
+					// carry no position of their own; fall back to
+					// the converted operand's.
+					pos = v.X.Pos()
+				}
+				idx.addIdentSpan(fset, pos, "implements", v.X.Type().String())
+			default:
+				if val, ok := instr.(ssa.Value); ok {
+					idx.indexType(fset, val)
+				}
+			}
+		}
+	}
+}
+
+// indexType records a "type" span for v's static type.
+func (idx *analysisIndex) indexType(fset *token.FileSet, v ssa.Value) {
+	idx.addIdentSpan(fset, v.Pos(), "type", v.Type().String())
+}
+
+// addIdentSpan records a span of kind at pos, deriving Start/End from
+// the identifier token that begins at pos, not from the length of
+// payload. SSA instructions don't retain the original ast.Ident, but
+// their Pos() still points at its first byte for most value-producing
+// instructions, so reading the identifier back out of the source
+// through the virtual file system recovers its true source extent. If
+// payload is nil, the identifier's own text is used as the payload
+// (e.g. a channel's name).
+func (idx *analysisIndex) addIdentSpan(fset *token.FileSet, pos token.Pos, kind string, payload interface{}) {
+	name, start, end, ok := identAt(fset, pos)
+	if !ok {
+		return
+	}
+	if payload == nil {
+		payload = name
+	}
+	idx.addSpan(fset.Position(pos).Filename, start, end, kind, payload)
+}
+
+// addSpanBefore records a span of kind over the identifier that
+// immediately precedes pos (skipping intervening whitespace), e.g. the
+// callee name before a call's Lparen, or the channel operand before a
+// send's "<-". If payload is nil, the identifier's own text is used.
+func (idx *analysisIndex) addSpanBefore(fset *token.FileSet, pos token.Pos, kind string, payload interface{}) {
+	name, start, end, ok := identBefore(fset, pos)
+	if !ok {
+		return
+	}
+	if payload == nil {
+		payload = name
+	}
+	idx.addSpan(fset.Position(pos).Filename, start, end, kind, payload)
+}
+
+// addSpanAfter records a span of kind over the identifier that follows
+// pos+skip (skipping intervening whitespace), e.g. the channel operand
+// after a receive's "<-". If payload is nil, the identifier's own text
+// is used.
+func (idx *analysisIndex) addSpanAfter(fset *token.FileSet, pos token.Pos, skip int, kind string, payload interface{}) {
+	name, start, end, ok := identAfter(fset, pos, skip)
+	if !ok {
+		return
+	}
+	if payload == nil {
+		payload = name
+	}
+	idx.addSpan(fset.Position(pos).Filename, start, end, kind, payload)
+}
+
+func (idx *analysisIndex) addSpan(file string, start, end int, kind string, payload interface{}) {
+	idx.spans[file] = append(idx.spans[file], Span{
+		Start:   start,
+		End:     end,
+		Kind:    kind,
+		Payload: payload,
+	})
+}
+
+// identAt reads the identifier-like token starting at pos directly out
+// of its source file (through readFile, so this also honors -zip and
+// -edit overlays), returning its text and byte offset range. It
+// reports ok=false if pos doesn't point at an identifier byte, e.g.
+// because the file is no longer readable or pos is synthetic.
+func identAt(fset *token.FileSet, pos token.Pos) (name string, start, end int, ok bool) {
+	if !pos.IsValid() {
+		return "", 0, 0, false
+	}
+	p := fset.Position(pos)
+	content, err := readFile(p.Filename)
+	if err != nil || p.Offset >= len(content) || !isIdentByte(content[p.Offset]) {
+		return "", 0, 0, false
+	}
+	start = p.Offset
+	end = start
+	for end < len(content) && isIdentByte(content[end]) {
+		end++
+	}
+	return string(content[start:end]), start, end, true
+}
+
+// identBefore reads the identifier that immediately precedes pos, once
+// any whitespace between them is skipped, e.g. the "Foo" in "Foo(" when
+// pos is the position of "(".
+func identBefore(fset *token.FileSet, pos token.Pos) (name string, start, end int, ok bool) {
+	if !pos.IsValid() {
+		return "", 0, 0, false
+	}
+	p := fset.Position(pos)
+	content, err := readFile(p.Filename)
+	if err != nil || p.Offset > len(content) {
+		return "", 0, 0, false
+	}
+	i := p.Offset
+	for i > 0 && isSpaceByte(content[i-1]) {
+		i--
+	}
+	end = i
+	for i > 0 && isIdentByte(content[i-1]) {
+		i--
+	}
+	start = i
+	if start == end {
+		return "", 0, 0, false
+	}
+	return string(content[start:end]), start, end, true
+}
+
+// identAfter reads the identifier that follows pos+skip, once any
+// whitespace between them is skipped, e.g. the "ch" in "<-ch" when pos
+// is the position of "<-" and skip is len("<-").
+func identAfter(fset *token.FileSet, pos token.Pos, skip int) (name string, start, end int, ok bool) {
+	if !pos.IsValid() {
+		return "", 0, 0, false
+	}
+	p := fset.Position(pos)
+	content, err := readFile(p.Filename)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	i := p.Offset + skip
+	if i > len(content) {
+		return "", 0, 0, false
+	}
+	for i < len(content) && isSpaceByte(content[i]) {
+		i++
+	}
+	start = i
+	for i < len(content) && isIdentByte(content[i]) {
+		i++
+	}
+	end = i
+	if start == end {
+		return "", 0, 0, false
+	}
+	return string(content[start:end]), start, end, true
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' ||
+		('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') ||
+		('0' <= b && b <= '9')
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+type byStart []Span
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Less(i, j int) bool { return s[i].Start < s[j].Start }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// serveAnalysis delivers the analysis overlay spans for a source file
+// as JSON, so the source view can render them as hover tooltips
+// without the user having to select text and pick a query mode first.
+// The request parameter is:
+//
+//   path: "/path/to/file.go"
+//
+// Returns a "403 Forbidden" status code if the requested file is not
+// within the import scope.
+func serveAnalysis(w http.ResponseWriter, req *http.Request) {
+	path := req.FormValue("path")
+	if isForbidden(path) {
+		errorForbidden(w)
+		return
+	}
+	mutex.Lock()
+	idx := analysisIdx
+	mutex.Unlock()
+	var spans []Span
+	if idx != nil {
+		spans = idx.ForFile(path)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(spans); err != nil {
+		log.Println(req.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2013 Frederik Zipp.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var cacheDir = flag.String("cachedir", "", "directory for on-disk spill of oracle query results, so they survive restarts")
+
+// cacheCapacity bounds the number of rendered query results kept in
+// memory. Evicted entries are still recoverable from -cachedir, if set.
+const cacheCapacity = 256
+
+// resultCache memoizes rendered oracle query responses, keyed by query
+// mode, the query position string exactly as given (it is not
+// normalized, so two spellings of the same position are cached
+// separately), output format, the SHA-256 of the
+// contents of the file the position refers to, and a scope fingerprint
+// computed once from args. Queries like callgraph, pointsto and
+// referrers are expensive and frequently repeated against an unchanged
+// source tree, so a cache hit is served without ever taking mutex or
+// calling into the oracle.
+type resultCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List // front = most recently used
+	fileHash   map[string][sha256.Size]byte
+	scope      string
+	generation int // bumped by flush, folded into every key
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+var cache = &resultCache{
+	entries:  make(map[string]*list.Element),
+	lru:      list.New(),
+	fileHash: make(map[string][sha256.Size]byte),
+}
+
+// key returns the cache key for a query against pos in the given mode
+// and format, or "" if the file pos refers to can't be read and
+// therefore can't be fingerprinted.
+func (c *resultCache) key(mode, pos, format string) string {
+	file := pos
+	if i := strings.Index(pos, ":#"); i >= 0 {
+		file = pos[:i]
+	}
+	hash, ok := c.hashOf(file)
+	if !ok {
+		return ""
+	}
+	c.mu.Lock()
+	gen := c.generation
+	c.mu.Unlock()
+	return fmt.Sprintf("%s|%s|%s|%x|%s|%d", mode, pos, format, hash, c.scopeFingerprint(), gen)
+}
+
+// scopeFingerprint returns a stable fingerprint of the import scope
+// the tool was launched with, computed on first use.
+func (c *resultCache) scopeFingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scope == "" {
+		sum := sha256.Sum256([]byte(strings.Join(args, "\x00")))
+		c.scope = hex.EncodeToString(sum[:])
+	}
+	return c.scope
+}
+
+// hashOf returns the cached SHA-256 of file, reading and hashing it
+// through the virtual file system on first use.
+func (c *resultCache) hashOf(file string) ([sha256.Size]byte, bool) {
+	c.mu.Lock()
+	h, ok := c.fileHash[file]
+	c.mu.Unlock()
+	if ok {
+		return h, true
+	}
+	content, err := readFile(file)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	h = sha256.Sum256(content)
+	c.mu.Lock()
+	c.fileHash[file] = h
+	c.mu.Unlock()
+	return h, true
+}
+
+// invalidate records the current hash of file's contents, so that any
+// cache entries keyed under its previous hash stop being returned.
+// serveFile calls this whenever it rereads a file from the virtual
+// file system.
+func (c *resultCache) invalidate(file string, content []byte) {
+	h := sha256.Sum256(content)
+	c.mu.Lock()
+	c.fileHash[file] = h
+	c.mu.Unlock()
+}
+
+// flush discards every in-memory entry and bumps generation, so that
+// every key computed afterwards differs from keys computed before the
+// call, even for a file whose own hash hasn't changed. rebuildPackage
+// calls this after a successful rebuild: oracle results are
+// whole-program, so a change anywhere in the scope can change the
+// answer for a query anchored in an untouched file, which a per-file
+// hash alone can't detect. Files under -cachedir are not removed, and
+// generation is not persisted: this process never looks up spill files
+// of an earlier generation again, but a later run starts again at
+// generation 0 and can read spill files written at generation 0 by an
+// earlier run.
+func (c *resultCache) flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.fileHash = make(map[string][sha256.Size]byte)
+	c.generation++
+	c.mu.Unlock()
+}
+
+// get returns the cached bytes for key, promoting it to
+// most-recently-used. If not held in memory, it falls back to the
+// on-disk spill directory named by -cachedir, if any.
+func (c *resultCache) get(key string) ([]byte, bool) {
+	if key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		v := e.Value.(*cacheEntry).value
+		c.mu.Unlock()
+		return v, true
+	}
+	c.mu.Unlock()
+
+	if *cacheDir == "" {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(c.diskPath(key))
+	if err != nil {
+		return nil, false
+	}
+	c.put(key, b)
+	return b, true
+}
+
+// put stores value under key, evicting the least recently used entry
+// once the in-memory cache is at capacity, and spilling to -cachedir
+// if set.
+func (c *resultCache) put(key string, value []byte) {
+	if key == "" {
+		return
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		e.Value.(*cacheEntry).value = value
+	} else {
+		e := c.lru.PushFront(&cacheEntry{key: key, value: value})
+		c.entries[key] = e
+		if c.lru.Len() > cacheCapacity {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+	c.mu.Unlock()
+
+	if *cacheDir != "" {
+		if err := os.MkdirAll(*cacheDir, 0755); err == nil {
+			ioutil.WriteFile(c.diskPath(key), value, 0644)
+		}
+	}
+}
+
+// diskPath returns the spill file for key under -cachedir.
+func (c *resultCache) diskPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(*cacheDir, hex.EncodeToString(sum[:])+".cache")
+}
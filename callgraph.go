@@ -0,0 +1,195 @@
+// Copyright 2013 Frederik Zipp.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"code.google.com/p/go.tools/oracle"
+)
+
+// focusHops is how many hops of the focused package's neighborhood
+// serveCallgraph keeps, to stop large whole-program graphs from
+// becoming unreadable.
+const focusHops = 2
+
+// callgraphNode mirrors the JSON form the oracle's callgraph mode
+// lowers its call graph to: one entry per function, identified by its
+// index in the array, with Children holding the indices of its
+// callees.
+type callgraphNode struct {
+	Name     string `json:"name"`
+	Pos      string `json:"pos"` // "file.go:line:col"
+	Children []int  `json:"children"`
+}
+
+// serveCallgraph renders the oracle's callgraph mode as an interactive
+// SVG, with each node hyperlinked back to the existing source view.
+// The request parameters are:
+//
+//   pos: file name with byte offset(s), as in serveQuery
+//   focus: optional package import path; the graph is pruned to the
+//          focusHops-hop neighborhood of nodes in that package
+func serveCallgraph(w http.ResponseWriter, req *http.Request) {
+	pos := req.FormValue("pos")
+	focus := req.FormValue("focus")
+
+	mutex.Lock()
+	curImp, curOra := imp, ora
+	mutex.Unlock()
+	qpos, err := oracle.ParseQueryPos(curImp, pos, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	res, err := curOra.Query("callgraph", qpos)
+	mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nodes, err := callgraphNodes(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if focus != "" {
+		nodes = pruneToNeighborhood(nodes, focus, focusHops)
+	}
+
+	svg, err := renderDot(callgraphDot(nodes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(svg)
+}
+
+// callgraphNodes extracts the callgraph node array from the oracle
+// result's JSON lowering.
+func callgraphNodes(res *oracle.Result) ([]callgraphNode, error) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	var wrapper struct {
+		Callgraph []callgraphNode `json:"callgraph"`
+	}
+	if err := json.Unmarshal(b, &wrapper); err != nil {
+		return nil, err
+	}
+	return wrapper.Callgraph, nil
+}
+
+// pruneToNeighborhood keeps only the nodes reachable within hops steps,
+// in either call direction, of a node whose name contains pkg.
+func pruneToNeighborhood(nodes []callgraphNode, pkg string, hops int) []callgraphNode {
+	callers := make(map[int][]int) // callee index -> caller indices
+	for i, n := range nodes {
+		for _, c := range n.Children {
+			callers[c] = append(callers[c], i)
+		}
+	}
+
+	keep := make(map[int]bool)
+	frontier := []int{}
+	for i, n := range nodes {
+		if strings.Contains(n.Name, pkg) {
+			keep[i] = true
+			frontier = append(frontier, i)
+		}
+	}
+	for h := 0; h < hops && len(frontier) > 0; h++ {
+		var next []int
+		for _, i := range frontier {
+			for _, c := range nodes[i].Children {
+				if !keep[c] {
+					keep[c] = true
+					next = append(next, c)
+				}
+			}
+			for _, c := range callers[i] {
+				if !keep[c] {
+					keep[c] = true
+					next = append(next, c)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	pruned := make([]callgraphNode, len(nodes))
+	for i, n := range nodes {
+		if !keep[i] {
+			continue
+		}
+		var children []int
+		for _, c := range n.Children {
+			if keep[c] {
+				children = append(children, c)
+			}
+		}
+		pruned[i] = callgraphNode{Name: n.Name, Pos: n.Pos, Children: children}
+	}
+	return pruned
+}
+
+// callgraphDot renders nodes as a DOT graph, with each node labeled by
+// function name and hyperlinked to the source view at its definition.
+func callgraphDot(nodes []callgraphNode) string {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "digraph callgraph {")
+	fmt.Fprintln(&buf, "\tnode [shape=box, fontsize=10];")
+	for i, n := range nodes {
+		if n.Name == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "\tN%d [label=%q, href=%q, target=\"_top\"];\n",
+			i, n.Name, sourceLink(n.Pos))
+	}
+	for i, n := range nodes {
+		for _, c := range n.Children {
+			fmt.Fprintf(&buf, "\tN%d -> N%d;\n", i, c)
+		}
+	}
+	fmt.Fprintln(&buf, "}")
+	return buf.String()
+}
+
+// sourceLink turns an oracle "file:line:col" position into a link to
+// the existing source view, selecting that single point.
+func sourceLink(pos string) string {
+	parts := strings.SplitN(pos, ":", 3)
+	if len(parts) != 3 {
+		return "#"
+	}
+	file, line, col := parts[0], parts[1], parts[2]
+	sel := fmt.Sprintf("%s.%s-%s.%s", line, col, line, col)
+	return "/source?file=" + template.URLQueryEscaper(file) + "&s=" + template.URLQueryEscaper(sel)
+}
+
+// renderDot shells out to graphviz's dot to lay out src as SVG.
+func renderDot(src string) ([]byte, error) {
+	cmd := exec.Command("dot", "-Tsvg")
+	cmd.Stdin = strings.NewReader(src)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Println("dot:", stderr.String())
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
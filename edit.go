@@ -0,0 +1,168 @@
+// Copyright 2013 Frederik Zipp.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"go/scanner"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var editMode = flag.Bool("edit", false, "enable an in-browser editor that writes files back to disk and re-analyzes them")
+
+// rebuildDebounce is how long servePutFile waits for writes to a file
+// to settle before re-running the importer on it, so that rapid
+// typing in the editor doesn't thrash the loader.
+const rebuildDebounce = 500 * time.Millisecond
+
+// pendingRebuilds holds one debounce timer per file awaiting
+// re-analysis.
+var pendingRebuilds = struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}{timers: make(map[string]*time.Timer)}
+
+// buildError is a single build or type error, reported back to the
+// editor so it can be shown inline in the gutter.
+type buildError struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Msg  string `json:"msg"`
+}
+
+// lastBuildErrors holds the build/type errors from the most recent
+// rebuild of each file, polled by the editor's gutter after a
+// debounced rebuild completes.
+var lastBuildErrors = struct {
+	mu   sync.Mutex
+	errs map[string][]buildError
+}{errs: make(map[string][]buildError)}
+
+// servePutFile handles "PUT /file?path=..." by writing the request
+// body back to path and scheduling a debounced re-analysis of the
+// whole import scope. It is only wired up when -edit is set.
+//
+// Returns "403 Forbidden" if editing is disabled, fs is not writable
+// (e.g. because -zip installed a read-only overlay, which would leave
+// the write on real disk while the importer keeps reading the zip),
+// or path is outside the import scope.
+func servePutFile(w http.ResponseWriter, req *http.Request) {
+	if !*editMode {
+		errorForbidden(w)
+		return
+	}
+	if !fsWritable {
+		http.Error(w, "editing is disabled: the active virtual file system is read-only", http.StatusForbidden)
+		return
+	}
+	path := req.FormValue("path")
+	if isForbidden(path) {
+		errorForbidden(w)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cache.invalidate(path, body)
+	scheduleRebuild(path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scheduleRebuild (re)starts the debounce timer for path, so a burst
+// of writes from the editor collapses into a single rebuildPackage
+// call.
+func scheduleRebuild(path string) {
+	pendingRebuilds.mu.Lock()
+	defer pendingRebuilds.mu.Unlock()
+	if t, ok := pendingRebuilds.timers[path]; ok {
+		t.Stop()
+	}
+	pendingRebuilds.timers[path] = time.AfterFunc(rebuildDebounce, func() {
+		rebuildPackage(path)
+	})
+}
+
+// rebuildPackage re-runs the importer for the whole import scope
+// (args), not only for the package containing path, and, on success,
+// rebuilds the SSA program, then swaps imp, packages, files,
+// ora and analysisIdx together in a single critical section, so that
+// serveQuery, serveCallgraph, serveIndex, isForbidden and serveAnalysis
+// never observe a query position parsed against one generation of the
+// program running against another. The result cache is flushed too:
+// oracle results are whole-program, so once any package in the scope
+// has changed, every cached entry is potentially stale, not just ones
+// anchored in path. Build and type errors are recorded for path
+// instead of being swapped in, so the editor can surface them in the
+// gutter without pythia serving stale or half-built state.
+func rebuildPackage(path string) {
+	newImp, newPackages, newFiles, newOra, err := loadScope(args)
+	if err != nil {
+		recordBuildErrors(path, err)
+		return
+	}
+	newIdx := buildAnalysisIndex(newImp.Program)
+	mutex.Lock()
+	imp = newImp
+	packages = newPackages
+	files = newFiles
+	ora = newOra
+	analysisIdx = newIdx
+	mutex.Unlock()
+	cache.flush()
+	clearBuildErrors(path)
+}
+
+// recordBuildErrors records err for path, splitting it into one
+// buildError per position when the loader reported a go/scanner
+// error list, so the editor can place each one on its own gutter line
+// instead of a single line-0 message.
+func recordBuildErrors(path string, err error) {
+	var errs []buildError
+	if list, ok := err.(scanner.ErrorList); ok {
+		for _, e := range list {
+			errs = append(errs, buildError{Path: e.Pos.Filename, Line: e.Pos.Line, Msg: e.Msg})
+		}
+	} else {
+		errs = []buildError{{Path: path, Line: 0, Msg: err.Error()}}
+	}
+	lastBuildErrors.mu.Lock()
+	defer lastBuildErrors.mu.Unlock()
+	lastBuildErrors.errs[path] = errs
+	log.Println("rebuild", path, err)
+}
+
+func clearBuildErrors(path string) {
+	lastBuildErrors.mu.Lock()
+	defer lastBuildErrors.mu.Unlock()
+	delete(lastBuildErrors.errs, path)
+}
+
+// serveBuildErrors delivers the build/type errors from the most recent
+// rebuild of a file as JSON, so the editor can poll for them after a
+// debounced rebuild completes and annotate its gutter. The request
+// parameter is:
+//
+//   path: "/path/to/file.go"
+func serveBuildErrors(w http.ResponseWriter, req *http.Request) {
+	path := req.FormValue("path")
+	lastBuildErrors.mu.Lock()
+	errs := lastBuildErrors.errs[path]
+	lastBuildErrors.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(errs); err != nil {
+		log.Println(req.RemoteAddr, err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"go/build"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"path/filepath"
@@ -59,12 +58,15 @@ func isStandardPackage(path string) bool {
 // serveIndex delivers the scope index page, which is the first
 // page presented to the user.
 func serveIndex(w http.ResponseWriter, req *http.Request) {
+	mutex.Lock()
+	pkgs := packages
+	mutex.Unlock()
 	err := indexView.Execute(w, struct {
 		Scope    string
 		Packages []*importer.PackageInfo
 	}{
 		Scope:    strings.Join(args, " "),
-		Packages: packages,
+		Packages: pkgs,
 	})
 	if err != nil {
 		log.Println(err)
@@ -110,12 +112,13 @@ func serveFile(w http.ResponseWriter, req *http.Request) {
 		errorForbidden(w)
 		return
 	}
-	content, err := ioutil.ReadFile(path)
+	content, err := readFile(path)
 	if err != nil {
 		log.Println(req.RemoteAddr, err)
 		http.NotFound(w, req)
 		return
 	}
+	cache.invalidate(path, content)
 
 	var sel godoc.Selection
 	s, err := parseSelection(req.FormValue("s"))
@@ -133,9 +136,11 @@ func serveFile(w http.ResponseWriter, req *http.Request) {
 // isForbidden checks if the given file path is in the file set of the
 // imported scope and returns true if not, otherwise false.
 func isForbidden(path string) bool {
-	// files must be sorted!
-	i := sort.SearchStrings(files, path)
-	return i >= len(files) || files[i] != path
+	mutex.Lock()
+	scope := files // files must be sorted!
+	mutex.Unlock()
+	i := sort.SearchStrings(scope, path)
+	return i >= len(scope) || scope[i] != path
 }
 
 func errorForbidden(w http.ResponseWriter) {
@@ -147,7 +152,7 @@ func errorForbidden(w http.ResponseWriter) {
 //
 //   mode: e.g. "describe", "callers", "freevars", ...
 //   pos: file name with byte offset(s), e.g. "/path/to/file.go:#1457,#1462"
-//   format: "json" or "plain", no "xml" at the moment
+//   format: "json", "plain" or "xml"
 //
 // If the application was launched in verbose mode, each query will be
 // logged like an invocation of the oracle command.
@@ -158,7 +163,20 @@ func serveQuery(w http.ResponseWriter, req *http.Request) {
 	if *verbose {
 		log.Println(req.RemoteAddr, cmdLine(mode, pos, format, args))
 	}
-	qpos, err := oracle.ParseQueryPos(imp, pos, false)
+	if format == "xml" {
+		w.Header().Set("Content-Type", "application/xml")
+	}
+
+	key := cache.key(mode, pos, format)
+	if b, ok := cache.get(key); ok {
+		w.Write(b)
+		return
+	}
+
+	mutex.Lock()
+	curImp := imp
+	mutex.Unlock()
+	qpos, err := oracle.ParseQueryPos(curImp, pos, false)
 	if err != nil {
 		io.WriteString(w, err.Error())
 		return
@@ -168,7 +186,13 @@ func serveQuery(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, err.Error())
 		return
 	}
-	writeResult(w, res, format)
+	var buf bytes.Buffer
+	if err := writeResult(&buf, res, mode, format); err != nil {
+		io.WriteString(w, err.Error())
+		return
+	}
+	cache.put(key, buf.Bytes())
+	buf.WriteTo(w)
 }
 
 func queryOracle(mode string, qpos *oracle.QueryPos) (*oracle.Result, error) {
@@ -178,18 +202,32 @@ func queryOracle(mode string, qpos *oracle.QueryPos) (*oracle.Result, error) {
 }
 
 // writeResult writes the result of an oracle query to w in the specified
-// format, "json" or "plain".
-func writeResult(w io.Writer, res *oracle.Result, format string) {
-	if format == "json" {
+// format, "json", "plain" or "xml". mode is the oracle query mode that
+// produced res, e.g. "describe" or "callgraph", and is used to name the
+// root element of the XML output. It returns an error, rather than
+// writing it to w itself, so that callers which cache the rendered
+// bytes (see serveQuery) can tell a failed serialization apart from a
+// real result and skip caching it.
+func writeResult(w io.Writer, res *oracle.Result, mode, format string) error {
+	switch format {
+	case "json":
 		b, err := json.Marshal(res)
 		if err != nil {
-			io.WriteString(w, err.Error())
-			return
+			return err
 		}
-		w.Write(b)
-		return
+		_, err = w.Write(b)
+		return err
+	case "xml":
+		b, err := marshalXML(res, mode)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	default:
+		_, err := res.WriteTo(w)
+		return err
 	}
-	res.WriteTo(w)
 }
 
 // serveStatic delivers the contents of a file from the static file map.
@@ -0,0 +1,146 @@
+// Copyright 2013 Frederik Zipp.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"go/build"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"code.google.com/p/go.tools/godoc/vfs"
+	"code.google.com/p/go.tools/godoc/vfs/mapfs"
+	"code.google.com/p/go.tools/godoc/vfs/zipfs"
+	"code.google.com/p/go.tools/importer"
+	"code.google.com/p/go.tools/oracle"
+)
+
+var (
+	zipFile   = flag.String("zip", "", "zip file containing the source tree to analyze, instead of reading from disk")
+	zipGoroot = flag.String("zipgoroot", "", "if -zip is given, the path within the zip file that corresponds to GOROOT")
+)
+
+// fs is the virtual file system that serveFile and the importer read
+// source files from. It defaults to the OS file system rooted at "/"
+// and is replaced by a zipfs (or, in tests, a mapfs) overlay when -zip
+// is given, so pythia can analyze code packaged inside a zip archive
+// or held entirely in memory.
+var fs vfs.FileSystem = vfs.OS("/")
+
+// fsWritable reports whether fs is still backed by the real OS file
+// system. zipfs and mapfs overlays are inherently read-only, so -edit
+// must refuse to write through them rather than writing straight to
+// disk while reads keep coming from the zip or in-memory tree.
+var fsWritable = true
+
+// openVFS sets up fs according to the -zip flag. It must be called
+// once at startup, before the importer and oracle are initialized, so
+// that every subsequent file access, both from the HTTP handlers and
+// from the importer's build context, goes through the same tree.
+func openVFS() error {
+	if *zipFile == "" {
+		return nil
+	}
+	rc, err := zip.OpenReader(*zipFile)
+	if err != nil {
+		return err
+	}
+	zfs := zipfs.New(rc, *zipFile)
+	fsWritable = false
+	if *zipGoroot == "" {
+		fs = zfs
+		return nil
+	}
+	// Bind the OS file system as the base of the namespace first, so
+	// that the codebase under analysis - which may live on disk
+	// outside the zip, or inside the zip outside zipGoroot - stays
+	// reachable. Only the zipGoroot subtree is then overlaid with the
+	// zip's contents, giving it priority over the base for paths under
+	// that prefix without hiding everything else.
+	ns := vfs.NameSpace{}
+	ns.Bind("/", vfs.OS("/"), "/", vfs.BindReplace)
+	ns.Bind(*zipGoroot, zfs, "/", vfs.BindBefore)
+	fs = ns
+	return nil
+}
+
+// mapVFS installs an in-memory file tree as fs, keyed by absolute file
+// name. It is intended for programmatic and test use, where the source
+// to analyze doesn't live on disk or in a zip file at all.
+func mapVFS(files map[string]string) {
+	fs = mapfs.New(files)
+	fsWritable = false
+}
+
+// readFile reads the named file through fs, so that it is served from
+// the active virtual file system, whether that's the OS file system,
+// a zip archive or an in-memory overlay.
+func readFile(path string) ([]byte, error) {
+	rc, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// buildContext returns a copy of build.Default whose file access hooks
+// are backed by fs, so that the importer picks up sources from the
+// active virtual file system, zipped or in-memory, rather than always
+// reading the real OS file system.
+func buildContext() *build.Context {
+	ctxt := build.Default
+	ctxt.OpenFile = func(path string) (io.ReadCloser, error) {
+		return fs.Open(path)
+	}
+	ctxt.IsDir = func(path string) bool {
+		fi, err := fs.Stat(path)
+		return err == nil && fi.IsDir()
+	}
+	ctxt.ReadDir = func(dir string) ([]os.FileInfo, error) {
+		return fs.ReadDir(dir)
+	}
+	return &ctxt
+}
+
+// loadScope builds a fresh importer, package list, sorted file list
+// and oracle for the given import scope (the args pythia was launched
+// or relaunched with). It threads buildContext's fs-backed build.Context
+// into the importer, so that -zip and -edit see the same source tree
+// the HTTP handlers do, rather than falling back to the real OS file
+// system for package loading while only serveFile and friends honor fs.
+//
+// loadScope is the single entry point for both the initial program
+// load and rebuildPackage's incremental reloads. openVFS must have
+// been called already, so fs reflects the requested -zip, if any.
+func loadScope(args []string) (imp *importer.Importer, pkgs []*importer.PackageInfo, files []string, ora *oracle.Oracle, err error) {
+	imp = importer.New(&importer.Config{Build: buildContext()})
+	pkgs, err = importer.LoadInitialPackages(imp, args)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	files = sourceFileNames(imp)
+	ora, err = oracle.New(imp, pkgs, nil, false)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return imp, pkgs, files, ora, nil
+}
+
+// sourceFileNames returns the sorted list of source file names known
+// to imp's file set, the invariant isForbidden relies on.
+func sourceFileNames(imp *importer.Importer) []string {
+	var names []string
+	imp.Fset.Iterate(func(f *token.File) bool {
+		names = append(names, f.Name())
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,117 @@
+// Copyright 2013 Frederik Zipp.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"code.google.com/p/go.tools/oracle"
+)
+
+// marshalXML renders res as XML. It reuses the same JSON lowering that
+// oracle.Result already provides for the "json" format and converts the
+// resulting tree into an XML document, rather than introducing a second,
+// parallel set of per-mode DTOs. The document's root element is named
+// after mode, e.g. <describeResult> or <callgraphResult>, so that
+// consumers can XSLT/XPath over results of a known query mode.
+func marshalXML(res *oracle.Result, mode string) ([]byte, error) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	root := xml.Name{Local: mode + "Result"}
+	var buf strings.Builder
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "\t")
+	if err := encodeXMLValue(enc, root, v); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return []byte(buf.String()), nil
+}
+
+// encodeXMLValue writes v as an XML element named name. Go values decoded
+// from JSON are limited to nil, bool, float64, string, []interface{} and
+// map[string]interface{}, so those are the only cases handled here.
+func encodeXMLValue(enc *xml.Encoder, name xml.Name, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		return enc.EncodeElement("", xml.StartElement{Name: name})
+	case bool, float64, string:
+		return enc.EncodeElement(fmt.Sprint(val), xml.StartElement{Name: name})
+	case []interface{}:
+		start := xml.StartElement{Name: name}
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, item := range val {
+			if err := encodeXMLValue(enc, xml.Name{Local: "item"}, item); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+	case map[string]interface{}:
+		start := xml.StartElement{Name: name}
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := encodeXMLValue(enc, xml.Name{Local: xmlSafeName(k)}, val[k]); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+	default:
+		return fmt.Errorf("xml: unsupported value of type %T", v)
+	}
+}
+
+// xmlSafeName maps a JSON field name to a valid XML element local
+// name, replacing any character that isn't allowed in that position
+// with "_". Today's oracle result keys are always plain identifiers,
+// but this keeps a future key that isn't from breaking xml.Encoder or
+// producing invalid XML.
+func xmlSafeName(name string) string {
+	if name == "" {
+		return "field"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case i == 0 && isXMLNameStartChar(r):
+			b.WriteRune(r)
+		case i > 0 && isXMLNameChar(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func isXMLNameStartChar(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+func isXMLNameChar(r rune) bool {
+	return isXMLNameStartChar(r) || unicode.IsDigit(r) || r == '-' || r == '.'
+}